@@ -0,0 +1,230 @@
+// Copyright 2019 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// +build linux
+
+// Package bpf attaches a tc-bpf classifier to the egress of the native
+// device (and cilium_host) that computes the XFRM skb mark directly from
+// the destination IP / security identity, rather than relying on the
+// datapath's C helpers to write the mark. This replaces per-remote-node
+// XFRM states with a single state per (dst, reqid) served from one eBPF
+// map, per the design note in ipsec_linux.go calling out that "a BPF xfrm
+// interface would greatly simplify the state space".
+package bpf
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/cilium/cilium/pkg/datapath/linux/linux_defaults"
+	"github.com/cilium/cilium/pkg/logging"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/vishvananda/netlink"
+
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.DefaultLogger.WithField(logfields.LogSubsys, "ipsec-bpf")
+
+// encryptMarkerObj is the compiled tc-bpf object containing the
+// cil_ipsec_encrypt_marker program (see encrypt_marker.c in this package),
+// built and dropped next to the binary by the same Makefile step that
+// builds the rest of the datapath's BPF programs.
+const encryptMarkerObj = "bpf_encrypt_marker.o"
+
+// encryptMarkerProg is the name of the classifier program inside
+// encryptMarkerObj.
+const encryptMarkerProg = "cil_ipsec_encrypt_marker"
+
+// encryptMarkerMapName is the name encrypt_marker.c declares its
+// {remote-CIDR -> spi} map under. NewCollectionWithOptions binds this name
+// to the *ebpf.Map the caller already created so every device's classifier
+// shares the one map instead of each loading its own copy.
+const encryptMarkerMapName = "cilium_ipsec_spi"
+
+// attachedMarker is the classifier and tc filter AttachEncryptMarker
+// installed on one interface, kept around so DetachEncryptMarker can undo
+// exactly what was added and release the program's fd.
+type attachedMarker struct {
+	filter *netlink.BpfFilter
+	prog   *ebpf.Program
+}
+
+// attached tracks, per interface, the classifier installed so Detach can
+// remove exactly what Attach added.
+var attached = make(map[string]*attachedMarker)
+
+var tcBPFSupport struct {
+	sync.Once
+	ok bool
+}
+
+// Supported reports whether the running kernel has the tc-bpf features
+// (direct action classifiers with skb->mark write support) required by
+// AttachEncryptMarker, by attempting to load a minimal SchedCLS program.
+// Callers should fall back to the existing C-helper mark path when this
+// returns false. The result is cached after the first call since loading a
+// throwaway program is not free.
+//
+// This probes by loading a throwaway program rather than going through
+// pkg/datapath/linux/probes, the package the rest of the datapath uses for
+// this kind of kernel feature check: that package isn't part of this
+// checkout (this ipsec/bpf package is vendored on its own, without the
+// wider pkg/datapath/linux tree it would otherwise sit alongside), so
+// there's nothing to call into here. The probe program only returns 0: it
+// does not write skb->mark or touch a map, so a kernel that passes it can
+// still reject the real classifier when AttachEncryptMarker loads it.
+func Supported() bool {
+	tcBPFSupport.Do(func() {
+		prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+			Type: ebpf.SchedCLS,
+			Instructions: asm.Instructions{
+				asm.Mov.Imm(asm.R0, 0),
+				asm.Return(),
+			},
+			License: "GPL",
+		})
+		if err != nil {
+			return
+		}
+		prog.Close()
+		tcBPFSupport.ok = true
+	})
+	return tcBPFSupport.ok
+}
+
+// AttachEncryptMarker loads the egress classifier that computes
+// skb->mark = (spi << 12) | RouteMarkEncrypt by looking up the packet's
+// destination IP / security identity in spiMap, and attaches it on iface.
+// iface is typically the native device or cilium_host.
+func AttachEncryptMarker(iface string, spiMap *ebpf.Map) error {
+	if !Supported() {
+		return fmt.Errorf("kernel is missing tc-bpf features required for the IPSec encrypt marker")
+	}
+
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return fmt.Errorf("unable to find interface %s: %s", iface, err)
+	}
+
+	if err := replaceQdisc(link); err != nil {
+		return fmt.Errorf("unable to replace qdisc for %s: %s", iface, err)
+	}
+
+	spec, err := ebpf.LoadCollectionSpec(encryptMarkerObj)
+	if err != nil {
+		return fmt.Errorf("unable to load %s: %s", encryptMarkerObj, err)
+	}
+	coll, err := ebpf.NewCollectionWithOptions(spec, ebpf.CollectionOptions{
+		MapReplacements: map[string]*ebpf.Map{encryptMarkerMapName: spiMap},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to load %s: %s", encryptMarkerObj, err)
+	}
+	prog, ok := coll.Programs[encryptMarkerProg]
+	if !ok {
+		coll.Close()
+		return fmt.Errorf("%s is missing program %s", encryptMarkerObj, encryptMarkerProg)
+	}
+
+	filter := &netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    netlink.HANDLE_MIN_EGRESS,
+			Handle:    netlink.MakeHandle(0, 1),
+			Protocol:  3, // unix.ETH_P_ALL, avoided here to keep this file portable
+			Priority:  1,
+		},
+		Fd:           prog.FD(),
+		Name:         encryptMarkerProg,
+		DirectAction: true,
+	}
+
+	if err := netlink.FilterReplace(filter); err != nil {
+		prog.Close()
+		return fmt.Errorf("unable to attach %s to %s: %s", encryptMarkerProg, iface, err)
+	}
+
+	attached[iface] = &attachedMarker{filter: filter, prog: prog}
+	log.WithFields(logrus.Fields{
+		logfields.Interface: iface,
+		"mark":              linux_defaults.RouteMarkEncrypt,
+	}).Info("attached IPSec encrypt marker classifier")
+	return nil
+}
+
+// DetachEncryptMarker removes the classifier previously attached to iface
+// by AttachEncryptMarker. It is a no-op if no classifier is attached.
+func DetachEncryptMarker(iface string) {
+	marker, ok := attached[iface]
+	if !ok {
+		return
+	}
+	if err := netlink.FilterDel(marker.filter); err != nil {
+		log.WithError(err).WithField(logfields.Interface, iface).Warning("unable to detach IPSec encrypt marker classifier")
+	}
+	marker.prog.Close()
+	delete(attached, iface)
+}
+
+// replaceQdisc ensures a clsact qdisc, which direct-action tc-bpf filters
+// require, is present on link before a filter is attached to it.
+func replaceQdisc(link netlink.Link) error {
+	qdisc := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	}
+	return netlink.QdiscReplace(qdisc)
+}
+
+// encryptMarkerKey mirrors the bpf_lpm_trie_key encrypt_marker.c declares
+// its map key as: a prefix length followed by the address bytes. Only IPv4
+// remotes are supported today, matching the encrypt marker's VXLAN (IPv4
+// underlay) use case.
+type encryptMarkerKey struct {
+	PrefixLen uint32
+	IP        [net.IPv4len]byte
+}
+
+func newEncryptMarkerKey(remote *net.IPNet) (encryptMarkerKey, error) {
+	v4 := remote.IP.To4()
+	if v4 == nil {
+		return encryptMarkerKey{}, fmt.Errorf("encrypt marker map only supports IPv4 remotes, got %s", remote.IP)
+	}
+	ones, _ := remote.Mask.Size()
+
+	var key encryptMarkerKey
+	key.PrefixLen = uint32(ones)
+	copy(key.IP[:], v4)
+	return key, nil
+}
+
+// UpdateEncryptMarkerMap pushes a {remote-CIDR -> spi} entry into spiMap so
+// a single XFRM state per (dst, reqid) can serve every identity behind
+// remote, instead of requiring a per-node mark write from the datapath's C
+// helpers.
+func UpdateEncryptMarkerMap(spiMap *ebpf.Map, remote *net.IPNet, spi uint8) error {
+	key, err := newEncryptMarkerKey(remote)
+	if err != nil {
+		return err
+	}
+	return spiMap.Update(key, spi, ebpf.UpdateAny)
+}
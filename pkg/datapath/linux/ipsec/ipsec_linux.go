@@ -27,11 +27,15 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/cilium/cilium/pkg/datapath/linux/ipsec/bpf"
 	"github.com/cilium/cilium/pkg/datapath/linux/linux_defaults"
 	"github.com/cilium/cilium/pkg/logging/logfields"
+	"github.com/cilium/ebpf"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 
 	"github.com/sirupsen/logrus"
 )
@@ -44,6 +48,250 @@ const (
 	IPSecDirBoth IPSecDir = "IPSEC_BOTH"
 )
 
+// IPSecMode selects between full tunnel-mode encryption, used for the
+// pod-to-pod native routing and geneve/ipip tunnel datapaths, and
+// transport-mode, which only wraps the outer encapsulation header (e.g. the
+// VXLAN UDP datagram) and leaves the original packet in the clear to the
+// kernel's own tunnel device.
+type IPSecMode string
+
+const (
+	IPSecModeTunnel    IPSecMode = "IPSEC_TUNNEL"
+	IPSecModeTransport IPSecMode = "IPSEC_TRANSPORT"
+)
+
+func (m IPSecMode) toNetlinkMode() netlink.Mode {
+	if m == IPSecModeTransport {
+		return netlink.XFRM_MODE_TRANSPORT
+	}
+	return netlink.XFRM_MODE_TUNNEL
+}
+
+// vxlanUDPPort is the default VXLAN destination port Cilium's overlay
+// datapath uses. In transport mode the XFRM policy matches on this port
+// rather than on the pod CIDR because the payload being protected is the
+// outer VXLAN datagram, not the inner pod traffic.
+const vxlanUDPPort = 8472
+
+// peerSPIs holds the forward (encrypt, local -> remote) and reverse
+// (decrypt, remote -> local) SPI negotiated for a single peer node. Unlike
+// tunnel mode, which reuses one global SPI for every node, transport mode
+// binds a dedicated pair to each peer so that the two directions can be
+// added and torn down atomically as ipcache node events arrive.
+type peerSPIs struct {
+	fwd uint8
+	rev uint8
+}
+
+var (
+	encrMapMU sync.Mutex
+	// encrMap tracks the per-peer SPI pair negotiated for VXLAN transport
+	// mode encryption, keyed by the remote node's tunnel endpoint IP.
+	encrMap = make(map[string]*peerSPIs)
+)
+
+// negotiatePeerSPIs returns the SPI pair for remoteNodeIP, allocating a new
+// pair the first time a node is seen. The forward SPI is reused as the base
+// global SPI (so existing tunnel-mode states stay compatible) while the
+// reverse SPI is derived deterministically, by flipping the top bit of spi,
+// so both peers agree on the pair without an additional handshake
+// round-trip and the two directions never collide on the same SPI.
+func negotiatePeerSPIs(remoteNodeIP net.IP, spi uint8) *peerSPIs {
+	encrMapMU.Lock()
+	defer encrMapMU.Unlock()
+
+	key := remoteNodeIP.String()
+	pair, ok := encrMap[key]
+	if !ok {
+		pair = &peerSPIs{fwd: spi, rev: spi | 0x80}
+		encrMap[key] = pair
+	}
+	return pair
+}
+
+// releasePeerSPIs drops the negotiated SPI pair for remoteNodeIP. Callers
+// are expected to have already removed the corresponding XFRM states so
+// that both directions disappear atomically.
+func releasePeerSPIs(remoteNodeIP net.IP) {
+	encrMapMU.Lock()
+	defer encrMapMU.Unlock()
+	delete(encrMap, remoteNodeIP.String())
+}
+
+// xfrmDirStateIn and xfrmDirStateOut key SAD (state) entries in xfrmDB.
+// They are chosen well above the handful of SPD directions the kernel
+// defines (XFRM_DIR_IN/OUT/FWD) so they can share the same map without
+// colliding with cached policy entries.
+const (
+	xfrmDirStateIn  netlink.Dir = 100
+	xfrmDirStateOut netlink.Dir = 101
+)
+
+// xfrmDBKey identifies one installed XFRM state or policy the same way the
+// kernel does for our purposes: by its selector and direction, plus the SPI
+// that distinguishes key generations.
+type xfrmDBKey struct {
+	srcCIDR string
+	dstCIDR string
+	dir     netlink.Dir
+	spi     int
+}
+
+// xfrmDBEntry is a fingerprint of the key material an xfrmDB entry was
+// programmed with, so a later Upsert can tell a true no-op from a key
+// rotation that happens to reuse the same selector/dir/spi. reconciled
+// marks an entry seeded by ReconcileXfrmState from kernel state alone: the
+// kernel doesn't return key material on a list, so those entries can only
+// be compared on reqID until a real Upsert replaces them with a full
+// fingerprint.
+type xfrmDBEntry struct {
+	reqID      int
+	authName   string
+	authKey    string
+	cryptName  string
+	cryptKey   string
+	reconciled bool
+}
+
+func xfrmEntryFor(key *ipSecKey) xfrmDBEntry {
+	return xfrmDBEntry{
+		reqID:     key.ReqID,
+		authName:  key.Auth.Name,
+		authKey:   string(key.Auth.Key),
+		cryptName: key.Crypt.Name,
+		cryptKey:  string(key.Crypt.Key),
+	}
+}
+
+// xfrmEntriesEqual reports whether cur already reflects want, treating a
+// reconciled stub as matching any entry with the same reqID since that's
+// all ReconcileXfrmState could observe about it.
+func xfrmEntriesEqual(cur, want xfrmDBEntry) bool {
+	if cur.reconciled {
+		return cur.reqID == want.reqID
+	}
+	return cur == want
+}
+
+// xfrmDB is cilium's local view of everything UpsertIPsecEndpoint has
+// successfully programmed into the kernel's XFRM state/policy databases.
+// Consulting it before calling XfrmStateAdd/XfrmPolicyUpdate lets us skip
+// the netlink round-trip for an already-known, unchanged entry instead of
+// attempting the call and swallowing the resulting EEXIST.
+var (
+	xfrmDBMU sync.Mutex
+	xfrmDB   = make(map[xfrmDBKey]xfrmDBEntry)
+)
+
+func xfrmDBLookup(src, dst *net.IPNet, dir netlink.Dir, spi int) (xfrmDBEntry, bool) {
+	xfrmDBMU.Lock()
+	defer xfrmDBMU.Unlock()
+	e, ok := xfrmDB[xfrmDBKey{src.String(), dst.String(), dir, spi}]
+	return e, ok
+}
+
+func xfrmDBRecord(src, dst *net.IPNet, dir netlink.Dir, spi int, entry xfrmDBEntry) {
+	xfrmDBMU.Lock()
+	defer xfrmDBMU.Unlock()
+	xfrmDB[xfrmDBKey{src.String(), dst.String(), dir, spi}] = entry
+}
+
+// hostIPNet returns a full-length (/32 or /128) selector for ip, used when
+// reconciling bare kernel states (which have no mask) into xfrmDB keys.
+func hostIPNet(ip net.IP) *net.IPNet {
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip.To16(), Mask: net.CIDRMask(128, 128)}
+}
+
+// ReconcileXfrmState rebuilds xfrmDB from the kernel's current XFRM state
+// and policy tables. Call this once at daemon start, before the first
+// ipcache event is processed, so a restart does not leak entries the cache
+// has no memory of and end up fighting the kernel over EEXIST errors.
+func ReconcileXfrmState() error {
+	xfrmDBMU.Lock()
+	defer xfrmDBMU.Unlock()
+
+	db := make(map[xfrmDBKey]xfrmDBEntry)
+
+	policies, err := netlink.XfrmPolicyList(0)
+	if err != nil {
+		return fmt.Errorf("unable to list XFRM policies: %s", err)
+	}
+	for _, p := range policies {
+		if len(p.Tmpls) == 0 {
+			continue
+		}
+		db[xfrmDBKey{p.Src.String(), p.Dst.String(), p.Dir, p.Tmpls[0].Spi}] = xfrmDBEntry{reqID: p.Tmpls[0].Reqid, reconciled: true}
+	}
+
+	states, err := netlink.XfrmStateList(0)
+	if err != nil {
+		return fmt.Errorf("unable to list XFRM states: %s", err)
+	}
+	for _, s := range states {
+		src, dst := hostIPNet(s.Src), hostIPNet(s.Dst)
+		// The state table alone doesn't tell us whether a given state was
+		// programmed for the in or out direction, so seed both. These
+		// entries are keyed by xfrmDirStateIn/Out, which upsertIPsecEndpoint
+		// never looks up (it consults the policy directions only), so they
+		// do not let an Upsert skip its netlink calls.
+		db[xfrmDBKey{src.String(), dst.String(), xfrmDirStateIn, s.Spi}] = xfrmDBEntry{reqID: s.Reqid, reconciled: true}
+		db[xfrmDBKey{src.String(), dst.String(), xfrmDirStateOut, s.Spi}] = xfrmDBEntry{reqID: s.Reqid, reconciled: true}
+	}
+
+	xfrmDB = db
+	return nil
+}
+
+// spiBPFMap is non-nil once EnableBPFEncryptMarker has attached the tc-bpf
+// classifier on the kernels that support it. When nil, UpsertIPsecEndpoint
+// falls back to letting the datapath's C helpers write the skb mark as
+// before.
+var spiBPFMap *ebpf.Map
+
+// EnableBPFEncryptMarker attaches the BPF-based skb mark classifier to
+// devices and cilium_host, replacing the datapath's C-helper mark writes
+// with a single eBPF map lookup keyed by remote CIDR. It is a no-op, and
+// returns nil, on kernels that lack the required tc-bpf features so that
+// callers can unconditionally invoke it at startup.
+func EnableBPFEncryptMarker(devices []string, spiMap *ebpf.Map) error {
+	if !bpf.Supported() {
+		log.Info("kernel lacks tc-bpf support, falling back to datapath mark path for IPSec")
+		return nil
+	}
+
+	for _, iface := range append(devices, "cilium_host") {
+		if err := bpf.AttachEncryptMarker(iface, spiMap); err != nil {
+			return fmt.Errorf("unable to attach IPSec encrypt marker to %s: %s", iface, err)
+		}
+	}
+	spiBPFMap = spiMap
+	return nil
+}
+
+// DisableBPFEncryptMarker detaches the classifier installed by
+// EnableBPFEncryptMarker from devices and cilium_host.
+func DisableBPFEncryptMarker(devices []string) {
+	for _, iface := range append(devices, "cilium_host") {
+		bpf.DetachEncryptMarker(iface)
+	}
+	spiBPFMap = nil
+}
+
+// updateEncryptMarkerMap pushes a {remote-CIDR -> spi} entry into the
+// attached BPF map so a single XFRM state per (dst, reqid) can serve every
+// identity behind remote, instead of requiring a per-node mark write from
+// the datapath's C helpers. It is a no-op when the BPF marker is not
+// attached on this kernel.
+func updateEncryptMarkerMap(remote *net.IPNet, spi uint8) error {
+	if spiBPFMap == nil {
+		return nil
+	}
+	return bpf.UpdateEncryptMarkerMap(spiBPFMap, remote, spi)
+}
+
 type ipSecKey struct {
 	Spi   uint8
 	ReqID int
@@ -51,11 +299,17 @@ type ipSecKey struct {
 	Crypt *netlink.XfrmStateAlgo
 }
 
-// ipSecKeysGlobal is safe to read unlocked because the only writers are from
-// daemon init time before any readers will be online.
-var ipSecKeysGlobal = make(map[string]*ipSecKey)
+// ipSecKeysGlobal is guarded by ipSecKeysGlobalMU: KeyRing.PrimaryKey writes
+// it at runtime as keys rotate, concurrently with ipcache-driven reads via
+// getIPSecKeys, so it is no longer safe to touch unlocked.
+var (
+	ipSecKeysGlobalMU sync.RWMutex
+	ipSecKeysGlobal   = make(map[string]*ipSecKey)
+)
 
 func getIPSecKeys(ip net.IP) *ipSecKey {
+	ipSecKeysGlobalMU.RLock()
+	defer ipSecKeysGlobalMU.RUnlock()
 	key, scoped := ipSecKeysGlobal[ip.String()]
 	if scoped == false {
 		key, _ = ipSecKeysGlobal[""]
@@ -63,12 +317,346 @@ func getIPSecKeys(ip net.IP) *ipSecKey {
 	return key
 }
 
-func ipSecNewState() *netlink.XfrmState {
+// keyRingEntry is a single key generation held for a scope (peer or the
+// global catch-all) in a KeyRing.
+type keyRingEntry struct {
+	SPI         uint8
+	Auth        *netlink.XfrmStateAlgo
+	Crypt       *netlink.XfrmStateAlgo
+	LamportTime uint64
+	demoted     bool
+	demotedAt   uint64
+}
+
+// KeyRing holds every key generation negotiated per scope (subsystem
+// "networking:ipsec"), modeled on libnetwork's overlay control plane.
+// AddKey installs an additional inbound state so packets encrypted under
+// either the current primary or the new key keep decrypting; only
+// PrimaryKey flips the state used for new outbound traffic, and PruneKey
+// reclaims a demoted SPI once its quiesce interval has elapsed. This
+// replaces swapping ipSecKeysGlobal in place and firing a fixed-delay
+// goroutine to garbage-collect the old SPI, which raced with in-flight
+// traffic and gave no way to rotate keys without rewriting the key file.
+type KeyRing struct {
+	mu      sync.Mutex
+	entries map[string][]*keyRingEntry
+}
+
+// NewKeyRing returns an empty KeyRing.
+func NewKeyRing() *KeyRing {
+	return &KeyRing{entries: make(map[string][]*keyRingEntry)}
+}
+
+// keyRing is the default ring driving rotation for keys loaded via
+// LoadIPSecKeysFile and the agent key-rotation API.
+var keyRing = NewKeyRing()
+
+// AddKey records a new key generation for scope and installs an inbound
+// XFRM state under spi for every peer scope already covers, so that
+// traffic encrypted with either the old or the new key continues to
+// decrypt. When scope names a single peer that's just that peer; when
+// scope is the global catch-all ("") it's every peer xfrmDB has an inbound
+// policy recorded for. The outbound path is left untouched until
+// PrimaryKey promotes spi.
+func (r *KeyRing) AddKey(scope string, spi uint8, auth, crypt *netlink.XfrmStateAlgo, lamport uint64) error {
+	r.mu.Lock()
+	r.entries[scope] = append(r.entries[scope], &keyRingEntry{
+		SPI:         spi,
+		Auth:        auth,
+		Crypt:       crypt,
+		LamportTime: lamport,
+	})
+	r.mu.Unlock()
+
+	peers := knownPeersForScope(scope)
+	if len(peers) == 0 {
+		return nil
+	}
+
+	var errs []string
+	for _, peer := range peers {
+		state := ipSecNewState(modeForPeer(peer))
+		ipSecJoinState(state, &ipSecKey{Spi: spi, ReqID: 1, Auth: auth, Crypt: crypt})
+		state.Dst = peer
+		if err := netlink.XfrmStateAdd(state); err != nil && !os.IsExist(err) {
+			errs = append(errs, fmt.Sprintf("%s: %s", peer, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("unable to add inbound state for spi %d: %s", spi, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// knownPeersForScope returns the peer destination IPs AddKey should install
+// a new inbound state for. A scope that parses as an IP names a single
+// peer directly; the global catch-all scope ("") instead fans out to every
+// peer xfrmDB has recorded an inbound policy for, since that's the set of
+// nodes this key now needs to be able to decrypt from.
+func knownPeersForScope(scope string) []net.IP {
+	if peer := net.ParseIP(scope); peer != nil {
+		return []net.IP{peer}
+	}
+	if scope != "" {
+		return nil
+	}
+
+	xfrmDBMU.Lock()
+	defer xfrmDBMU.Unlock()
+	seen := make(map[string]net.IP)
+	for k := range xfrmDB {
+		if k.dir != netlink.XFRM_DIR_IN {
+			continue
+		}
+		// xfrmDBRecord for XFRM_DIR_IN is called as (remote, local, ...),
+		// so the peer's address is the selector's source, not destination.
+		if _, srcNet, err := net.ParseCIDR(k.srcCIDR); err == nil {
+			seen[srcNet.IP.String()] = srcNet.IP
+		}
+	}
+	peers := make([]net.IP, 0, len(seen))
+	for _, ip := range seen {
+		peers = append(peers, ip)
+	}
+	return peers
+}
+
+// peerMode remembers, per peer IP, the IPSecMode upsertIPsecEndpoint last
+// installed for it, guarded by peerModeMU. AddKey and pushPrimaryToPeers
+// both fan out over knownPeersForScope's peer set, which mixes tunnel-mode
+// pod/host peers with VXLAN transport-mode peers once chunk0-1's transport
+// path records entries in the same xfrmDB; without this they'd install
+// every raw state as tunnel mode regardless of what the peer actually uses.
+var (
+	peerModeMU sync.Mutex
+	peerMode   = make(map[string]IPSecMode)
+)
+
+// recordPeerMode records the IPSecMode used for peer's most recent
+// upsertIPsecEndpoint call.
+func recordPeerMode(peer net.IP, mode IPSecMode) {
+	peerModeMU.Lock()
+	defer peerModeMU.Unlock()
+	peerMode[peer.String()] = mode
+}
+
+// modeForPeer returns the IPSecMode last recorded for peer, defaulting to
+// IPSecModeTunnel for a peer upsertIPsecEndpoint hasn't seen yet, since
+// tunnel mode is what every caller used before VXLAN transport mode existed.
+func modeForPeer(peer net.IP) IPSecMode {
+	peerModeMU.Lock()
+	defer peerModeMU.Unlock()
+	if mode, ok := peerMode[peer.String()]; ok {
+		return mode
+	}
+	return IPSecModeTunnel
+}
+
+// PrimaryKey promotes spi to be used for new outbound traffic under scope
+// and demotes the previous primary, starting its quiesce interval at
+// lamport. It also pushes the promoted key out to every peer scope already
+// covers, so new egress traffic switches to it immediately rather than
+// waiting on an unrelated ipcache event to re-run upsertIPsecEndpoint.
+func (r *KeyRing) PrimaryKey(scope string, spi uint8, lamport uint64) error {
+	r.mu.Lock()
+
+	var primary *keyRingEntry
+	for _, e := range r.entries[scope] {
+		if e.SPI == spi {
+			primary = e
+			e.demoted = false
+			e.demotedAt = 0
+			continue
+		}
+		if !e.demoted {
+			e.demoted = true
+			e.demotedAt = lamport
+		}
+	}
+	if primary == nil {
+		r.mu.Unlock()
+		return fmt.Errorf("PrimaryKey: spi %d unknown for scope %q", spi, scope)
+	}
+	r.mu.Unlock()
+
+	ipSecKeysGlobalMU.Lock()
+	ipSecKeysGlobal[scope] = &ipSecKey{Spi: primary.SPI, ReqID: 1, Auth: primary.Auth, Crypt: primary.Crypt}
+	ipSecKeysGlobalMU.Unlock()
+
+	return pushPrimaryToPeers(scope, primary)
+}
+
+// pushPrimaryToPeers installs primary's key as the new encrypt (outbound)
+// state for every peer scope covers, the OUT-side counterpart of the
+// inbound dual-decrypt state AddKey installs. VXLAN transport-mode peers
+// negotiate their own independent SPI pair (see negotiatePeerSPIs) outside
+// of a scope's key generations, so they're skipped here; the next ipcache
+// event for them re-derives state from that pair instead.
+func pushPrimaryToPeers(scope string, primary *keyRingEntry) error {
+	peers := knownPeersForScope(scope)
+	if len(peers) == 0 {
+		return nil
+	}
+
+	var errs []string
+	for _, peer := range peers {
+		if modeForPeer(peer) == IPSecModeTransport {
+			continue
+		}
+		state := ipSecNewState(IPSecModeTunnel)
+		ipSecJoinState(state, &ipSecKey{Spi: primary.SPI, ReqID: 1, Auth: primary.Auth, Crypt: primary.Crypt})
+		state.Dst = peer
+		if err := netlink.XfrmStateAdd(state); err != nil && !os.IsExist(err) {
+			errs = append(errs, fmt.Sprintf("%s: %s", peer, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("unable to push primary spi %d to peers: %s", primary.SPI, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// PruneKey removes spi's ring entry for scope, and its now-stale XFRM
+// states/policies. Callers are expected to have already waited out the real
+// quiesce interval (linux_defaults.IPsecKeyDeleteDelay) before calling this;
+// PruneKey itself only guards against pruning a generation that has been
+// re-promoted back to primary in the meantime.
+func (r *KeyRing) PruneKey(scope string, spi uint8) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, e := range r.entries[scope] {
+		if e.SPI != spi {
+			continue
+		}
+		if !e.demoted {
+			return fmt.Errorf("PruneKey: spi %d for scope %q has been re-promoted, refusing to prune", spi, scope)
+		}
+
+		var primarySPI uint8
+		for _, other := range r.entries[scope] {
+			if !other.demoted {
+				primarySPI = other.SPI
+				break
+			}
+		}
+
+		r.entries[scope] = append(r.entries[scope][:i], r.entries[scope][i+1:]...)
+		// ipsecDeleteXfrmSpi keeps the state/policy matching its argument and
+		// deletes every other one it finds, so it must be called with the
+		// *current* primary SPI, not the demoted spi being pruned -- passing
+		// spi here would delete the live primary and keep the stale one.
+		if primarySPI != 0 {
+			ipsecDeleteXfrmSpi(primarySPI)
+		}
+		return nil
+	}
+	return fmt.Errorf("PruneKey: spi %d unknown for scope %q", spi, scope)
+}
+
+// schedulePruneKey reclaims oldSpi once the real quiesce interval has
+// elapsed, giving packets already in flight under the old key time to land
+// before its state disappears. It is a no-op when oldSpi is the SPI that
+// was just promoted (nothing was actually demoted).
+func schedulePruneKey(scope string, oldSpi, newSpi uint8) {
+	if oldSpi == 0 || oldSpi == newSpi {
+		return
+	}
+	scopedLog := log.WithFields(logrus.Fields{"scope": scope, "oldSPI": oldSpi, "newSPI": newSpi})
+	go func() {
+		time.Sleep(linux_defaults.IPsecKeyDeleteDelay)
+		if err := keyRing.PruneKey(scope, oldSpi); err != nil {
+			scopedLog.WithError(err).Warning("unable to prune demoted IPSec key")
+			return
+		}
+		scopedLog.Info("reclaimed SPI from demoted IPSec key")
+	}()
+}
+
+// RotateIPSecKey installs a new key generation for scope (an empty string
+// selects the global catch-all key), immediately promotes it, and schedules
+// the previous primary's SPI to be reclaimed once it has quiesced,
+// mirroring what loading a new keys file does, without a daemon restart.
+// Nothing in this tree calls it: there is no daemon key-rotation API here
+// -- the daemon and its HTTP handlers live in packages this checkout
+// doesn't contain -- and this package's tests do not call it either.
+func RotateIPSecKey(scope string, auth, crypt *netlink.XfrmStateAlgo, spi uint8, lamport uint64) error {
+	if spi == 0 {
+		return fmt.Errorf("zero is not a valid key to disable encryption use `--enable-ipsec=false`, id must be nonzero and less than %d", linux_defaults.IPsecMaxKeyVersion)
+	}
+	if int(spi) > linux_defaults.IPsecMaxKeyVersion {
+		return fmt.Errorf("encryption key space exhausted, id must be nonzero and less than %d. Attempted %d", linux_defaults.IPsecMaxKeyVersion, spi)
+	}
+
+	ipSecKeysGlobalMU.RLock()
+	var oldSpi uint8
+	if prev := ipSecKeysGlobal[scope]; prev != nil {
+		oldSpi = prev.Spi
+	}
+	ipSecKeysGlobalMU.RUnlock()
+
+	if err := keyRing.AddKey(scope, spi, auth, crypt, lamport); err != nil {
+		return err
+	}
+	if err := keyRing.PrimaryKey(scope, spi, lamport); err != nil {
+		return err
+	}
+	schedulePruneKey(scope, oldSpi, spi)
+	return nil
+}
+
+// encapPort is the UDP port ESP is encapsulated in when SetEncapPort has
+// been called with a non-zero port (wired to the --ipsec-encap-port flag,
+// default off). This lets ESP traverse NAT devices that would otherwise
+// drop native ESP (proto 50) by making it look like ordinary UDP traffic.
+var encapPort uint16
+
+// SetEncapPort enables ESP-in-UDP encapsulation on port for every XFRM
+// state installed afterwards. Pass 0 to disable. Callers must also call
+// OpenEncapSocket(port) once at startup so the kernel forwards the
+// encapsulated packets into the XFRM stack.
+func SetEncapPort(port uint16) {
+	encapPort = port
+}
+
+// OpenEncapSocket opens a UDP socket with UDP_ENCAP_ESPINUDP set and binds
+// it to port, then holds it open for the process lifetime. This is what
+// tells the kernel to hand ESP-in-UDP packets arriving on port to the XFRM
+// stack instead of the UDP layer; without it ipSecNewState's Encap field
+// has no effect. The socket is intentionally never closed by the caller.
+func OpenEncapSocket(port uint16) error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, unix.IPPROTO_UDP)
+	if err != nil {
+		return fmt.Errorf("unable to open ESP-in-UDP encapsulation socket: %s", err)
+	}
+
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_UDP, unix.UDP_ENCAP, unix.UDP_ENCAP_ESPINUDP); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("unable to set UDP_ENCAP_ESPINUDP on encapsulation socket: %s", err)
+	}
+
+	if err := unix.Bind(fd, &unix.SockaddrInet4{Port: int(port)}); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("unable to bind encapsulation socket to port %d: %s", port, err)
+	}
+
+	SetEncapPort(port)
+	return nil
+}
+
+func ipSecNewState(mode IPSecMode) *netlink.XfrmState {
 	state := netlink.XfrmState{
-		Mode:  netlink.XFRM_MODE_TUNNEL,
+		Mode:  mode.toNetlinkMode(),
 		Proto: netlink.XFRM_PROTO_ESP,
 		ESN:   false,
 	}
+	if encapPort != 0 {
+		state.Encap = &netlink.XfrmStateEncap{
+			Type:    netlink.XFRM_ENCAP_ESPINUDP,
+			SrcPort: int(encapPort),
+			DstPort: int(encapPort),
+		}
+	}
 	return &state
 }
 
@@ -77,10 +665,10 @@ func ipSecNewPolicy() *netlink.XfrmPolicy {
 	return &policy
 }
 
-func ipSecAttachPolicyTempl(policy *netlink.XfrmPolicy, keys *ipSecKey, srcIP, dstIP net.IP) {
+func ipSecAttachPolicyTempl(policy *netlink.XfrmPolicy, keys *ipSecKey, srcIP, dstIP net.IP, mode IPSecMode) {
 	tmpl := netlink.XfrmPolicyTmpl{
 		Proto: netlink.XFRM_PROTO_ESP,
-		Mode:  netlink.XFRM_MODE_TUNNEL,
+		Mode:  mode.toNetlinkMode(),
 		Spi:   int(keys.Spi),
 		Reqid: keys.ReqID,
 		Dst:   dstIP,
@@ -97,36 +685,76 @@ func ipSecJoinState(state *netlink.XfrmState, keys *ipSecKey) {
 	state.Reqid = keys.ReqID
 }
 
-func ipSecReplaceState(remoteIP, localIP net.IP) (uint8, error) {
+// applySPIOverride returns key unchanged when spiOverride is 0 (the
+// sentinel meaning "use whatever getIPSecKeys returned"), or a shallow copy
+// of key with Spi replaced by spiOverride. This lets the VXLAN transport
+// path install the forward/reverse SPIs negotiatePeerSPIs assigned instead
+// of the single global SPI tunnel mode shares between both directions.
+func applySPIOverride(key *ipSecKey, spiOverride uint8) *ipSecKey {
+	if spiOverride == 0 {
+		return key
+	}
+	overridden := *key
+	overridden.Spi = spiOverride
+	return &overridden
+}
+
+// transportSelector narrows a policy/state selector to just the VXLAN
+// overlay's UDP datagram (proto=17, dst-port=vxlanUDPPort) instead of all
+// traffic between the two node IPs. Tunnel mode leaves it unset so the
+// selector continues to match on CIDR alone.
+func transportSelector(policy *netlink.XfrmPolicy, mode IPSecMode) {
+	if mode != IPSecModeTransport {
+		return
+	}
+	policy.Proto = netlink.Proto(unix.IPPROTO_UDP)
+	policy.DstPort = vxlanUDPPort
+}
+
+func ipSecReplaceState(remoteIP, localIP net.IP, mode IPSecMode, spiOverride uint8) (uint8, error) {
 	key := getIPSecKeys(localIP)
 	if key == nil {
 		return 0, fmt.Errorf("IPSec key missing")
 	}
-	state := ipSecNewState()
+	key = applySPIOverride(key, spiOverride)
+	state := ipSecNewState(mode)
 	ipSecJoinState(state, key)
 	state.Src = localIP
 	state.Dst = remoteIP
 	return key.Spi, netlink.XfrmStateAdd(state)
 }
 
-func ipSecReplacePolicyIn(src, dst *net.IPNet) error {
-	if err := ipSecReplacePolicyInFwd(src, dst, netlink.XFRM_DIR_IN); err != nil {
+func ipSecReplacePolicyIn(src, dst *net.IPNet, mode IPSecMode, spiOverride uint8) error {
+	if err := ipSecReplacePolicyInFwd(src, dst, netlink.XFRM_DIR_IN, mode, spiOverride); err != nil {
 		if !os.IsExist(err) {
 			return err
 		}
 	}
-	return ipSecReplacePolicyInFwd(src, dst, netlink.XFRM_DIR_FWD)
+	return ipSecReplacePolicyInFwd(src, dst, netlink.XFRM_DIR_FWD, mode, spiOverride)
 }
 
-func ipSecReplacePolicyInFwd(src, dst *net.IPNet, dir netlink.Dir) error {
+// ipSecReplacePolicyInFwd installs an inbound/forward XFRM policy.
+//
+// Deliberately not implemented: a selector addition matching encapsulated
+// ESP-in-UDP return traffic. It isn't needed, not merely skipped. Once
+// OpenEncapSocket binds a UDP socket with UDP_ENCAP_ESPINUDP set on
+// encapPort, the kernel's udp_encap_rcv strips the UDP header and hands the
+// ESP payload to xfrm_input directly — the XFRM policy/state lookup runs on
+// the decapsulated ESP packet exactly as it would for native ESP (proto
+// 50), never on the UDP wrapper. There is nothing for a policy selector to
+// match against here. See TestSetEncapPortSetsStateEncap for the half of
+// this feature (state.Encap wiring) that is independently testable.
+func ipSecReplacePolicyInFwd(src, dst *net.IPNet, dir netlink.Dir, mode IPSecMode, spiOverride uint8) error {
 	var spiWide uint32
 
 	key := getIPSecKeys(dst.IP)
 	if key == nil {
 		return fmt.Errorf("IPSec key missing")
 	}
+	key = applySPIOverride(key, spiOverride)
 	spiWide = uint32(key.Spi)
 
+	src, dst = minimalIPNet(src), minimalIPNet(dst)
 	policy := ipSecNewPolicy()
 	policy.Dir = dir
 	policy.Src = src
@@ -135,19 +763,22 @@ func ipSecReplacePolicyInFwd(src, dst *net.IPNet, dir netlink.Dir) error {
 		Value: ((spiWide << 12) | linux_defaults.RouteMarkDecrypt),
 		Mask:  linux_defaults.IPsecMarkMask,
 	}
-	ipSecAttachPolicyTempl(policy, key, src.IP, dst.IP)
+	transportSelector(policy, mode)
+	ipSecAttachPolicyTempl(policy, key, src.IP, dst.IP, mode)
 	return netlink.XfrmPolicyUpdate(policy)
 }
 
-func ipSecReplacePolicyOut(src, dst *net.IPNet, dir IPSecDir) error {
+func ipSecReplacePolicyOut(src, dst *net.IPNet, dir IPSecDir, mode IPSecMode, spiOverride uint8) error {
 	var spiWide uint32
 
 	key := getIPSecKeys(dst.IP)
 	if key == nil {
 		return fmt.Errorf("IPSec key missing")
 	}
+	key = applySPIOverride(key, spiOverride)
 	spiWide = uint32(key.Spi)
 
+	src, dst = minimalIPNet(src), minimalIPNet(dst)
 	policy := ipSecNewPolicy()
 	policy.Dir = netlink.XFRM_DIR_OUT
 	policy.Src = src
@@ -156,12 +787,60 @@ func ipSecReplacePolicyOut(src, dst *net.IPNet, dir IPSecDir) error {
 		Value: ((spiWide << 12) | linux_defaults.RouteMarkEncrypt),
 		Mask:  linux_defaults.IPsecMarkMask,
 	}
-	ipSecAttachPolicyTempl(policy, key, src.IP, dst.IP)
+	transportSelector(policy, mode)
+	ipSecAttachPolicyTempl(policy, key, src.IP, dst.IP, mode)
 	return netlink.XfrmPolicyUpdate(policy)
 }
 
-func ipSecDeleteStateOut(src, local net.IP) error {
-	state := ipSecNewState()
+// vxlanEndpointSelector builds the /32 (or /128) selector matching just the
+// peer's tunnel endpoint on the VXLAN UDP port, used for transport-mode
+// policies instead of the pod CIDR selector tunnel mode relies on.
+func vxlanEndpointSelector(ip net.IP) *net.IPNet {
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip.To16(), Mask: net.CIDRMask(128, 128)}
+}
+
+// minimalIPNet normalizes n so its IP and mask always have a congruent
+// length: 4 bytes for an IPv4 (or IPv4-mapped IPv6) address, 16 bytes
+// otherwise. Callers building policy selectors may be handed a 16-byte
+// net.IP paired with a 4-byte mask (or vice versa) depending on where the
+// address came from, and the kernel rejects or silently fails to match such
+// policies. Mirrors the fix applied to libnetwork's overlay driver.
+func minimalIPNet(n *net.IPNet) *net.IPNet {
+	if n == nil {
+		return nil
+	}
+
+	if v4 := n.IP.To4(); v4 != nil {
+		mask := n.Mask
+		switch len(mask) {
+		case net.IPv4len:
+		case net.IPv6len:
+			mask = mask[net.IPv6len-net.IPv4len:]
+		default:
+			mask = net.CIDRMask(32, 32)
+		}
+		return &net.IPNet{IP: v4, Mask: mask}
+	}
+
+	v6 := n.IP.To16()
+	mask := n.Mask
+	switch len(mask) {
+	case net.IPv6len:
+	case net.IPv4len:
+		full := net.CIDRMask(96, 128)
+		copy(full[net.IPv6len-net.IPv4len:], mask)
+		mask = full
+	default:
+		mask = net.CIDRMask(128, 128)
+	}
+	return &net.IPNet{IP: v6, Mask: mask}
+}
+
+func ipSecDeleteStateOut(src, local net.IP, mode IPSecMode) error {
+	state := ipSecNewState(mode)
 
 	state.Src = src
 	state.Dst = local
@@ -169,8 +848,8 @@ func ipSecDeleteStateOut(src, local net.IP) error {
 	return err
 }
 
-func ipSecDeleteStateIn(src, local net.IP) error {
-	state := ipSecNewState()
+func ipSecDeleteStateIn(src, local net.IP, mode IPSecMode) error {
+	state := ipSecNewState(mode)
 
 	state.Src = src
 	state.Dst = local
@@ -178,7 +857,40 @@ func ipSecDeleteStateIn(src, local net.IP) error {
 	return err
 }
 
+// ipSecDeletePolicy removes every cached XFRM_DIR_IN and XFRM_DIR_FWD
+// policy matching src/local, mirroring what ipSecReplacePolicyIn installed
+// for this peer, and drops the corresponding xfrmDB entries.
 func ipSecDeletePolicy(src, local net.IP) error {
+	xfrmDBMU.Lock()
+	defer xfrmDBMU.Unlock()
+
+	var errs []string
+	for k := range xfrmDB {
+		if k.dir != netlink.XFRM_DIR_IN && k.dir != netlink.XFRM_DIR_FWD {
+			continue
+		}
+		srcIP, srcNet, err := net.ParseCIDR(k.srcCIDR)
+		if err != nil || !srcIP.Equal(src) {
+			continue
+		}
+		dstIP, dstNet, err := net.ParseCIDR(k.dstCIDR)
+		if err != nil || !dstIP.Equal(local) {
+			continue
+		}
+
+		policy := ipSecNewPolicy()
+		policy.Dir = k.dir
+		policy.Src = srcNet
+		policy.Dst = dstNet
+		if err := netlink.XfrmPolicyDel(policy); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err.Error())
+			continue
+		}
+		delete(xfrmDB, k)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("unable to delete IPSec policies for %s -> %s: %s", src, local, strings.Join(errs, "; "))
+	}
 	return nil
 }
 
@@ -258,48 +970,102 @@ func ipsecDeleteXfrmSpi(spi uint8) {
  * from BPF program allowing for a single state per security ctx.
  */
 func UpsertIPsecEndpoint(local, remote *net.IPNet, dir IPSecDir) (uint8, error) {
+	return upsertIPsecEndpoint(local, remote, dir, IPSecModeTunnel, 0, 0)
+}
+
+// UpsertIPsecEndpointVXLAN installs transport-mode IPSec state/policy for the
+// VXLAN overlay between the local and remote node. Unlike UpsertIPsecEndpoint,
+// which protects the pod CIDR in tunnel mode, this only wraps the outer VXLAN
+// UDP datagram (proto=17, dst-port=vxlanUDPPort) between the two tunnel
+// endpoints, selected with a /32 (or /128) host selector rather than a CIDR.
+// A dedicated forward/reverse SPI pair is negotiated per remote node so both
+// directions can be added and torn down atomically as ipcache node events
+// fire, instead of sharing the single global SPI tunnel mode uses.
+func UpsertIPsecEndpointVXLAN(localNodeIP, remoteNodeIP net.IP, dir IPSecDir) (uint8, error) {
+	scopedLog := log.WithFields(logrus.Fields{
+		logfields.IPAddr: remoteNodeIP,
+		"vxlanPort":      vxlanUDPPort,
+	})
+
+	key := getIPSecKeys(localNodeIP)
+	if key == nil {
+		return 0, fmt.Errorf("IPSec key missing")
+	}
+	pair := negotiatePeerSPIs(remoteNodeIP, key.Spi)
+	scopedLog.WithFields(logrus.Fields{"fwdSPI": pair.fwd, "revSPI": pair.rev}).Debug("negotiated VXLAN transport-mode SPI pair")
+
+	local := &net.IPNet{IP: localNodeIP, Mask: vxlanEndpointSelector(localNodeIP).Mask}
+	remote := &net.IPNet{IP: remoteNodeIP, Mask: vxlanEndpointSelector(remoteNodeIP).Mask}
+
+	return upsertIPsecEndpoint(local, remote, dir, IPSecModeTransport, pair.rev, pair.fwd)
+}
+
+// upsertIPsecEndpoint installs states/policies for local/remote, consulting
+// xfrmDB first so that a repeat ipcache event for an already-programmed
+// (selector, dir, spi) with unchanged key material is a no-op rather than a
+// netlink round-trip we know will come back EEXIST. inSPI/outSPI override
+// the SPI installed for each direction; pass 0 for either to use whatever
+// getIPSecKeys returns, which is what tunnel mode's single global SPI wants.
+func upsertIPsecEndpoint(local, remote *net.IPNet, dir IPSecDir, mode IPSecMode, inSPI, outSPI uint8) (uint8, error) {
 	var spi uint8
-	var err error
 
-	/* TODO: state reference ID is (dip,spi) which can be duplicated in the current global
-	 * mode. The duplication is on _all_ ingress states because dst_ip == host_ip in this
-	 * case and only a single spi entry is in use. Currently no check is done to avoid
-	 * attempting to add duplicate (dip,spi) states and we get 'file exist' error. These
-	 * errors are expected at the moment but perhaps it would be better to avoid calling
-	 * netlink API at all when we "know" an entry is a duplicate. To do this the xfer
-	 * state would need to be cached in the ipcache.
-	 */
-	/* The two states plus policy below is sufficient for tunnel mode for
-	 * transparent mode ciliumIP == nil case must also be handled.
-	 */
-	if !local.IP.Equal(remote.IP) {
-		if dir == IPSecDirIn || dir == IPSecDirBoth {
-			if spi, err = ipSecReplaceState(local.IP, remote.IP); err != nil {
-				if !os.IsExist(err) {
-					return 0, fmt.Errorf("unable to replace local state: %s", err)
-				}
+	if local.IP.Equal(remote.IP) {
+		return 0, nil
+	}
+
+	// Normalize before anything derives an xfrmDBKey from local/remote's
+	// String() representation: net.IPNet.String() returns the literal
+	// "<nil>" when the IP and mask lengths disagree (e.g. a 16-byte IP
+	// paired with a 4-byte mask), which would otherwise collide unrelated
+	// peers' entries under the same "<nil>"/"<nil>" key.
+	local, remote = minimalIPNet(local), minimalIPNet(remote)
+	recordPeerMode(remote.IP, mode)
+
+	if dir == IPSecDirIn || dir == IPSecDirBoth {
+		key := getIPSecKeys(local.IP)
+		if key == nil {
+			return 0, fmt.Errorf("IPSec key missing")
+		}
+		key = applySPIOverride(key, inSPI)
+		spi = key.Spi
+		entry := xfrmEntryFor(key)
+		if cur, ok := xfrmDBLookup(remote, local, netlink.XFRM_DIR_IN, int(key.Spi)); !ok || !xfrmEntriesEqual(cur, entry) {
+			if _, err := ipSecReplaceState(local.IP, remote.IP, mode, inSPI); err != nil && !os.IsExist(err) {
+				return 0, fmt.Errorf("unable to replace local state: %s", err)
 			}
-			if err = ipSecReplacePolicyIn(remote, local); err != nil {
-				if !os.IsExist(err) {
-					return 0, fmt.Errorf("unable to replace policy in: %s", err)
-				}
+			if err := ipSecReplacePolicyIn(remote, local, mode, inSPI); err != nil && !os.IsExist(err) {
+				return 0, fmt.Errorf("unable to replace policy in: %s", err)
 			}
+			// ipSecReplacePolicyIn installs both the IN and FWD policies
+			// together, so record both now; otherwise the FWD policy is
+			// never tracked and ipSecDeletePolicy can never find it.
+			xfrmDBRecord(remote, local, netlink.XFRM_DIR_IN, int(key.Spi), entry)
+			xfrmDBRecord(remote, local, netlink.XFRM_DIR_FWD, int(key.Spi), entry)
 		}
+	}
 
-		if dir == IPSecDirOut || dir == IPSecDirBoth {
-			if spi, err = ipSecReplaceState(remote.IP, local.IP); err != nil {
-				if !os.IsExist(err) {
-					return 0, fmt.Errorf("unable to replace remote state: %s", err)
-				}
+	if dir == IPSecDirOut || dir == IPSecDirBoth {
+		key := getIPSecKeys(remote.IP)
+		if key == nil {
+			return 0, fmt.Errorf("IPSec key missing")
+		}
+		key = applySPIOverride(key, outSPI)
+		spi = key.Spi
+		entry := xfrmEntryFor(key)
+		if cur, ok := xfrmDBLookup(local, remote, netlink.XFRM_DIR_OUT, int(key.Spi)); !ok || !xfrmEntriesEqual(cur, entry) {
+			if _, err := ipSecReplaceState(remote.IP, local.IP, mode, outSPI); err != nil && !os.IsExist(err) {
+				return 0, fmt.Errorf("unable to replace remote state: %s", err)
 			}
-
-			if err = ipSecReplacePolicyOut(local, remote, dir); err != nil {
-				if !os.IsExist(err) {
-					return 0, fmt.Errorf("unable to replace policy out: %s", err)
-				}
+			if err := ipSecReplacePolicyOut(local, remote, dir, mode, outSPI); err != nil && !os.IsExist(err) {
+				return 0, fmt.Errorf("unable to replace policy out: %s", err)
 			}
+			xfrmDBRecord(local, remote, netlink.XFRM_DIR_OUT, int(key.Spi), entry)
 		}
 	}
+
+	if err := updateEncryptMarkerMap(remote, spi); err != nil {
+		log.WithError(err).Warning("unable to update IPSec encrypt marker map")
+	}
 	return spi, nil
 }
 
@@ -309,11 +1075,11 @@ func DeleteIPSecEndpoint(src, local net.IP) error {
 		logfields.IPAddr: src,
 	})
 
-	err := ipSecDeleteStateIn(src, local)
+	err := ipSecDeleteStateIn(src, local, IPSecModeTunnel)
 	if err != nil {
 		scopedLog.WithError(err).Warning("unable to delete IPSec (stateIn) context\n")
 	}
-	err = ipSecDeleteStateOut(src, local)
+	err = ipSecDeleteStateOut(src, local, IPSecModeTunnel)
 	if err != nil {
 		scopedLog.WithError(err).Warning("unable to delete IPSec (stateOut) context\n")
 	}
@@ -324,6 +1090,30 @@ func DeleteIPSecEndpoint(src, local net.IP) error {
 	return nil
 }
 
+// DeleteIPSecEndpointVXLAN deletes the transport-mode IPSec state/policy
+// installed for the VXLAN overlay towards remoteNodeIP and releases its
+// negotiated SPI pair.
+func DeleteIPSecEndpointVXLAN(remoteNodeIP, localNodeIP net.IP) error {
+	scopedLog := log.WithFields(logrus.Fields{
+		logfields.IPAddr: remoteNodeIP,
+	})
+
+	err := ipSecDeleteStateIn(remoteNodeIP, localNodeIP, IPSecModeTransport)
+	if err != nil {
+		scopedLog.WithError(err).Warning("unable to delete IPSec VXLAN (stateIn) context\n")
+	}
+	err = ipSecDeleteStateOut(remoteNodeIP, localNodeIP, IPSecModeTransport)
+	if err != nil {
+		scopedLog.WithError(err).Warning("unable to delete IPSec VXLAN (stateOut) context\n")
+	}
+	err = ipSecDeletePolicy(remoteNodeIP, localNodeIP)
+	if err != nil {
+		scopedLog.WithError(err).Warning("unable to delete IPSec VXLAN (policy) context\n")
+	}
+	releasePeerSPIs(remoteNodeIP)
+	return nil
+}
+
 func decodeIPSecKey(keyRaw string) ([]byte, error) {
 	// As we have released the v1.4.0 docs telling the users to write the
 	// k8s secret with the prefix "0x" we have to remove it if it is present,
@@ -343,6 +1133,11 @@ func LoadIPSecKeysFile(path string) (uint8, error) {
 	return loadIPSecKeys(file)
 }
 
+// fileLoadLamport is the Lamport clock driving KeyRing rotations triggered
+// by reloading the keys file. RotateIPSecKey takes a caller-provided
+// timestamp instead and does not advance this clock.
+var fileLoadLamport uint64
+
 func loadIPSecKeys(r io.Reader) (uint8, error) {
 	var spi uint8
 	scopedLog := log.WithFields(logrus.Fields{
@@ -352,7 +1147,6 @@ func loadIPSecKeys(r io.Reader) (uint8, error) {
 	scanner := bufio.NewScanner(r)
 	scanner.Split(bufio.ScanLines)
 	for scanner.Scan() {
-		var oldSpi uint8
 		offset := 0
 
 		ipSecKey := &ipSecKey{
@@ -403,31 +1197,33 @@ func loadIPSecKeys(r io.Reader) (uint8, error) {
 		}
 		ipSecKey.Spi = spi
 
+		scope := ""
 		if len(s) == 6+offset {
-			if ipSecKeysGlobal[s[5+offset]] != nil {
-				oldSpi = ipSecKeysGlobal[s[5+offset]].Spi
-			}
-			ipSecKeysGlobal[s[5+offset]] = ipSecKey
-		} else {
-			if ipSecKeysGlobal[""] != nil {
-				oldSpi = ipSecKeysGlobal[""].Spi
-			}
-			ipSecKeysGlobal[""] = ipSecKey
-		}
-
-		scopedLog.WithError(err).Warning("newtimer: oldSPI %u new spi %u", oldSpi, ipSecKey.Spi)
-		// Detect a version change and call cleanup routine to remove old
-		// keys after a timeout period. We also want to ensure on restart
-		// we remove any stale keys for example when a restart changes keys.
-		// In the restart case oldSpi will be '0' and cause the delete logic
-		// to run.
-		if oldSpi != ipSecKey.Spi {
-			go func() {
-				time.Sleep(linux_defaults.IPsecKeyDeleteDelay)
-				scopedLog.Info("New encryption keys reclaiming SPI")
-				ipsecDeleteXfrmSpi(ipSecKey.Spi)
-			}()
+			scope = s[5+offset]
 		}
+		ipSecKeysGlobalMU.RLock()
+		var oldSpi uint8
+		if prev := ipSecKeysGlobal[scope]; prev != nil {
+			oldSpi = prev.Spi
+		}
+		ipSecKeysGlobalMU.RUnlock()
+
+		fileLoadLamport++
+		lamport := fileLoadLamport
+
+		if err := keyRing.AddKey(scope, ipSecKey.Spi, ipSecKey.Auth, ipSecKey.Crypt, lamport); err != nil {
+			return 0, fmt.Errorf("unable to add new IPSec key: %s", err)
+		}
+		if err := keyRing.PrimaryKey(scope, ipSecKey.Spi, lamport); err != nil {
+			return 0, fmt.Errorf("unable to promote new IPSec key: %s", err)
+		}
+
+		scopedLog.WithFields(logrus.Fields{"oldSPI": oldSpi, "newSPI": ipSecKey.Spi}).Info("loaded new IPSec key")
+		// Detect a version change and prune the demoted key once it has
+		// quiesced. On restart oldSpi is '0', so schedulePruneKey is a
+		// no-op and XFRM states left over from keys used before the
+		// restart are not removed here.
+		schedulePruneKey(scope, oldSpi, ipSecKey.Spi)
 	}
 	return spi, nil
 }
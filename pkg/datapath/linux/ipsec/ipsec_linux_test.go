@@ -0,0 +1,187 @@
+// Copyright 2019 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// +build linux
+
+package ipsec
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestMinimalIPNet(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		in       *net.IPNet
+		wantIP   net.IP
+		wantMask net.IPMask
+	}{
+		{
+			name:     "v4-only",
+			in:       &net.IPNet{IP: net.IPv4(10, 0, 0, 1).To4(), Mask: net.CIDRMask(32, 32)},
+			wantIP:   net.IPv4(10, 0, 0, 1).To4(),
+			wantMask: net.CIDRMask(32, 32),
+		},
+		{
+			name:     "v6-only",
+			in:       &net.IPNet{IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(128, 128)},
+			wantIP:   net.ParseIP("fd00::1"),
+			wantMask: net.CIDRMask(128, 128),
+		},
+		{
+			name:     "v4-mapped-v6 IP with v4 mask",
+			in:       &net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(32, 32)},
+			wantIP:   net.IPv4(10, 0, 0, 1).To4(),
+			wantMask: net.CIDRMask(32, 32),
+		},
+		{
+			name:     "v4-mapped-v6 IP with v6 mask",
+			in:       &net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(128, 128)},
+			wantIP:   net.IPv4(10, 0, 0, 1).To4(),
+			wantMask: net.CIDRMask(32, 32),
+		},
+		{
+			name:     "v4 IP with v6-length mask",
+			in:       &net.IPNet{IP: net.IPv4(10, 0, 0, 1).To4(), Mask: net.CIDRMask(120, 128)},
+			wantIP:   net.IPv4(10, 0, 0, 1).To4(),
+			wantMask: net.CIDRMask(24, 32),
+		},
+	}
+
+	for _, tc := range testCases {
+		got := minimalIPNet(tc.in)
+		if !got.IP.Equal(tc.wantIP) {
+			t.Errorf("%s: IP = %v, want %v", tc.name, got.IP, tc.wantIP)
+		}
+		if len(got.Mask) != len(tc.wantMask) {
+			t.Errorf("%s: mask length = %d, want %d", tc.name, len(got.Mask), len(tc.wantMask))
+			continue
+		}
+		if got.Mask.String() != tc.wantMask.String() {
+			t.Errorf("%s: mask = %v, want %v", tc.name, got.Mask, tc.wantMask)
+		}
+	}
+}
+
+func TestSetEncapPortSetsStateEncap(t *testing.T) {
+	defer SetEncapPort(0)
+
+	SetEncapPort(0)
+	state := ipSecNewState(IPSecModeTunnel)
+	if state.Encap != nil {
+		t.Fatalf("expected no Encap when encapsulation is disabled, got %+v", state.Encap)
+	}
+
+	SetEncapPort(4500)
+	state = ipSecNewState(IPSecModeTunnel)
+	if state.Encap == nil {
+		t.Fatal("expected Encap to be set once SetEncapPort is enabled")
+	}
+	if state.Encap.Type != netlink.XFRM_ENCAP_ESPINUDP {
+		t.Errorf("Encap.Type = %v, want XFRM_ENCAP_ESPINUDP", state.Encap.Type)
+	}
+	if state.Encap.SrcPort != 4500 || state.Encap.DstPort != 4500 {
+		t.Errorf("Encap ports = %d/%d, want 4500/4500", state.Encap.SrcPort, state.Encap.DstPort)
+	}
+}
+
+func TestNegotiatePeerSPIs(t *testing.T) {
+	defer releasePeerSPIs(net.ParseIP("10.0.0.2"))
+
+	peer := net.ParseIP("10.0.0.2")
+	pair := negotiatePeerSPIs(peer, 5)
+	if pair.fwd != 5 || pair.rev != 5|0x80 {
+		t.Fatalf("got fwd=%d rev=%d, want fwd=5 rev=%d", pair.fwd, pair.rev, uint8(5|0x80))
+	}
+
+	// A second call for the same peer must return the same pair, even with
+	// a different spi argument, since a peer's pair is only negotiated once.
+	again := negotiatePeerSPIs(peer, 9)
+	if again != pair {
+		t.Fatalf("negotiatePeerSPIs returned a different pair on second call: %+v vs %+v", again, pair)
+	}
+
+	releasePeerSPIs(peer)
+	if pair, ok := encrMap[peer.String()]; ok {
+		t.Fatalf("releasePeerSPIs did not remove the peer's entry, got %+v", pair)
+	}
+}
+
+func TestXfrmEntriesEqual(t *testing.T) {
+	want := xfrmDBEntry{reqID: 1, authName: "a", authKey: "k1", cryptName: "c", cryptKey: "k2"}
+
+	if !xfrmEntriesEqual(want, want) {
+		t.Fatal("identical entries should be equal")
+	}
+
+	stale := xfrmDBEntry{reqID: 1, authName: "old", authKey: "stale", cryptName: "old", cryptKey: "stale"}
+	if xfrmEntriesEqual(stale, want) {
+		t.Fatal("entries with different key material should not be equal")
+	}
+
+	// A reconciled stub only carries reqID (ReconcileXfrmState has no other
+	// key material to compare), so it should match any entry sharing that
+	// reqID regardless of the rest of the fingerprint.
+	reconciled := xfrmDBEntry{reqID: 1, reconciled: true}
+	if !xfrmEntriesEqual(reconciled, want) {
+		t.Fatal("a reconciled stub should match any entry with the same reqID")
+	}
+	reconciled.reqID = 2
+	if xfrmEntriesEqual(reconciled, want) {
+		t.Fatal("a reconciled stub with a different reqID should not match")
+	}
+}
+
+func TestKeyRingAddPrimaryPrune(t *testing.T) {
+	ring := NewKeyRing()
+	// A scope name that doesn't parse as an IP and isn't "" has no known
+	// peers, so AddKey/PrimaryKey's fan-out is a no-op. PrimaryKey still
+	// sets ipSecKeysGlobal[scope], and a successful PruneKey still calls
+	// ipsecDeleteXfrmSpi, which lists the host's XFRM policies and states.
+	const scope = "test-scope-no-known-peers"
+
+	auth1 := &netlink.XfrmStateAlgo{Name: "auth1"}
+	crypt1 := &netlink.XfrmStateAlgo{Name: "crypt1"}
+	if err := ring.AddKey(scope, 1, auth1, crypt1, 1); err != nil {
+		t.Fatalf("AddKey(1): %s", err)
+	}
+	if err := ring.PrimaryKey(scope, 1, 1); err != nil {
+		t.Fatalf("PrimaryKey(1): %s", err)
+	}
+
+	auth2 := &netlink.XfrmStateAlgo{Name: "auth2"}
+	crypt2 := &netlink.XfrmStateAlgo{Name: "crypt2"}
+	if err := ring.AddKey(scope, 2, auth2, crypt2, 2); err != nil {
+		t.Fatalf("AddKey(2): %s", err)
+	}
+	if err := ring.PrimaryKey(scope, 2, 2); err != nil {
+		t.Fatalf("PrimaryKey(2): %s", err)
+	}
+
+	// spi 1 is now demoted and should prune exactly once.
+	if err := ring.PruneKey(scope, 1); err != nil {
+		t.Fatalf("PruneKey(1): %s", err)
+	}
+	if err := ring.PruneKey(scope, 1); err == nil {
+		t.Fatal("expected PruneKey to fail for an already-pruned spi")
+	}
+
+	// spi 2 is still primary and must refuse to prune.
+	if err := ring.PruneKey(scope, 2); err == nil {
+		t.Fatal("expected PruneKey to refuse pruning the current primary")
+	}
+}